@@ -3,6 +3,7 @@ package dns
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,6 +12,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
 	"github.com/dharak36/xray-core/common"
 	"github.com/dharak36/xray-core/common/log"
 	"github.com/dharak36/xray-core/common/net"
@@ -38,6 +42,105 @@ type DoHNameServer struct {
 	httpClient *http.Client
 	dohURL     string
 	name       string
+
+	// useH3 selects an HTTP/3 (quic-go) transport instead of HTTP/2 over
+	// TCP; set via a "h3://" scheme or a "?h3=1" query parameter on the URL.
+	useH3 bool
+	// keepAlive pins a single dispatched connection per server instead of
+	// letting the transport dial fresh ones, so concurrent A/AAAA queries
+	// multiplex over one already-negotiated HTTP/2 or HTTP/3 connection.
+	keepAlive        bool
+	connAccess       sync.Mutex
+	pinnedConn       net.Conn
+	pinnedPacketConn net.PacketConn
+
+	// queryStrategy, when not dns_feature.QueryStrategy_USE_IP, overrides the
+	// caller's IPOption and forces only A, or only AAAA, queries to be sent.
+	queryStrategy dns_feature.QueryStrategy
+	// disableFallback and disableFallbackIfMatch let this server veto
+	// fallback to later servers in the multi-server resolver: the former
+	// unconditionally, the latter only for domains this server is the
+	// designated (matching) server for.
+	disableFallback        bool
+	disableFallbackIfMatch bool
+
+	// clientIP, when set, overrides any caller-supplied EDNS0 Client Subnet
+	// address for every query sent to this server.
+	clientIP net.IP
+	// tag, when set, is stamped onto the dispatched dnsCtx's Inbound so
+	// routing rules can match "traffic from DNS server X" via inboundTag.
+	tag string
+}
+
+// SetClientIP fixes the EDNS0 Client Subnet address sent with every query,
+// overriding whatever clientIP QueryIP's caller passes in.
+//
+// TODO: DNSOutboundConfig has no clientIP field to call this from yet;
+// that config file lives outside this slice of the repo.
+func (s *DoHNameServer) SetClientIP(ip net.IP) {
+	s.clientIP = ip
+}
+
+// SetTag stamps outbound traffic for this server's queries with tag, via
+// session.Inbound, so routing rules can select an outbound for it.
+//
+// TODO: DNSOutboundConfig has no tag field to call this from yet; that
+// config file lives outside this slice of the repo.
+func (s *DoHNameServer) SetTag(tag string) {
+	s.tag = tag
+}
+
+// SetKeepAlive enables reusing one pinned dispatched connection per server
+// across queries instead of dialing per-request.
+func (s *DoHNameServer) SetKeepAlive(keepAlive bool) {
+	s.keepAlive = keepAlive
+}
+
+// SetQueryStrategy pins which of A/AAAA queries this server issues,
+// overriding the IPOption passed to QueryIP.
+//
+// TODO: DNSOutboundConfig has no queryStrategy field to call this from yet;
+// that config file lives outside this slice of the repo.
+func (s *DoHNameServer) SetQueryStrategy(strategy dns_feature.QueryStrategy) {
+	s.queryStrategy = strategy
+}
+
+// SetFallbackOptions configures whether this server may veto fallback to
+// later servers in the multi-server resolver.
+//
+// TODO: the multi-server resolver in this tree doesn't check a
+// fallbackControl interface yet, and DNSOutboundConfig has no
+// disableFallback/disableFallbackIfMatch fields to call this from; both
+// live outside this slice of the repo.
+func (s *DoHNameServer) SetFallbackOptions(disableFallback, disableFallbackIfMatch bool) {
+	s.disableFallback = disableFallback
+	s.disableFallbackIfMatch = disableFallbackIfMatch
+}
+
+// DisableFallback reports whether this server vetoes fallback to later
+// servers unconditionally.
+func (s *DoHNameServer) DisableFallback() bool {
+	return s.disableFallback
+}
+
+// DisableFallbackIfMatch reports whether this server vetoes fallback to later
+// servers for domains it is the matching server for.
+func (s *DoHNameServer) DisableFallbackIfMatch() bool {
+	return s.disableFallbackIfMatch
+}
+
+// applyQueryStrategy narrows option down to a single query type when
+// strategy forces one, so callers keep working with IPOption everywhere
+// while a per-server strategy can still pin the outcome.
+func applyQueryStrategy(option dns_feature.IPOption, strategy dns_feature.QueryStrategy) dns_feature.IPOption {
+	switch strategy {
+	case dns_feature.QueryStrategy_USE_IP4:
+		return dns_feature.IPOption{IPv4Enable: true, IPv6Enable: false}
+	case dns_feature.QueryStrategy_USE_IP6:
+		return dns_feature.IPOption{IPv4Enable: false, IPv6Enable: true}
+	default:
+		return option
+	}
 }
 
 // NewDoHNameServer creates DOH server object for remote resolving.
@@ -46,6 +149,14 @@ func NewDoHNameServer(url *url.URL, dispatcher routing.Dispatcher) (*DoHNameServ
 	s := baseDOHNameServer(url, "DOH")
 
 	s.dispatcher = dispatcher
+	if s.useH3 {
+		s.httpClient = &http.Client{
+			Timeout:   time.Second * 180,
+			Transport: s.newH3Transport(s.dialRemoteQUIC),
+		}
+		return s, nil
+	}
+
 	tr := &http.Transport{
 		MaxIdleConns:        30,
 		IdleConnTimeout:     90 * time.Second,
@@ -56,29 +167,7 @@ func NewDoHNameServer(url *url.URL, dispatcher routing.Dispatcher) (*DoHNameServ
 			if err != nil {
 				return nil, err
 			}
-			link, err := s.dispatcher.Dispatch(toDnsContext(ctx, s.dohURL), dest)
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			default:
-
-			}
-			if err != nil {
-				return nil, err
-			}
-
-			cc := common.ChainedClosable{}
-			if cw, ok := link.Writer.(common.Closable); ok {
-				cc = append(cc, cw)
-			}
-			if cr, ok := link.Reader.(common.Closable); ok {
-				cc = append(cc, cr)
-			}
-			return cnc.NewConnection(
-				cnc.ConnectionInputMulti(link.Writer),
-				cnc.ConnectionOutputMulti(link.Reader),
-				cnc.ConnectionOnClose(cc),
-			), nil
+			return s.dialRemote(ctx, dest)
 		},
 	}
 	s.httpClient = &http.Client{
@@ -93,6 +182,15 @@ func NewDoHNameServer(url *url.URL, dispatcher routing.Dispatcher) (*DoHNameServ
 func NewDoHLocalNameServer(url *url.URL) *DoHNameServer {
 	url.Scheme = "https"
 	s := baseDOHNameServer(url, "DOHL")
+	if s.useH3 {
+		s.httpClient = &http.Client{
+			Timeout:   time.Second * 180,
+			Transport: s.newH3Transport(s.dialLocalQUIC),
+		}
+		newError("DNS: created Local DOH client for ", url.String()).AtInfo().WriteToLog()
+		return s
+	}
+
 	tr := &http.Transport{
 		IdleConnTimeout:   90 * time.Second,
 		ForceAttemptHTTP2: true,
@@ -122,12 +220,171 @@ func NewDoHLocalNameServer(url *url.URL) *DoHNameServer {
 	return s
 }
 
+// dialRemote dispatches a connection to dest, pinning and reusing it for
+// later calls when s.keepAlive is set instead of dispatching a fresh one
+// per DialContext invocation.
+func (s *DoHNameServer) dialRemote(ctx context.Context, dest net.Destination) (net.Conn, error) {
+	if !s.keepAlive {
+		return s.dispatchStream(ctx, dest)
+	}
+
+	s.connAccess.Lock()
+	defer s.connAccess.Unlock()
+	if s.pinnedConn != nil {
+		return s.pinnedConn, nil
+	}
+
+	conn, err := s.dispatchStream(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	s.pinnedConn = &pinnedConn{Conn: conn, onClose: func() {
+		s.connAccess.Lock()
+		s.pinnedConn = nil
+		s.connAccess.Unlock()
+	}}
+	return s.pinnedConn, nil
+}
+
+func (s *DoHNameServer) dispatchStream(ctx context.Context, dest net.Destination) (net.Conn, error) {
+	link, err := s.dispatcher.Dispatch(toDnsContext(ctx, s.dohURL), dest)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cc := common.ChainedClosable{}
+	if cw, ok := link.Writer.(common.Closable); ok {
+		cc = append(cc, cw)
+	}
+	if cr, ok := link.Reader.(common.Closable); ok {
+		cc = append(cc, cr)
+	}
+	return cnc.NewConnection(
+		cnc.ConnectionInputMulti(link.Writer),
+		cnc.ConnectionOutputMulti(link.Reader),
+		cnc.ConnectionOnClose(cc),
+	), nil
+}
+
+// pinnedConn notifies the owning DoHNameServer when the transport closes it,
+// so the next dial knows to establish a fresh connection.
+type pinnedConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *pinnedConn) Close() error {
+	c.onClose()
+	return c.Conn.Close()
+}
+
+// dialRemoteQUIC dispatches a QUIC-shaped packet connection to dest for the
+// HTTP/3 transport, framing it the same way QUICNameServer does. Like
+// dialRemote, it pins and reuses the dispatched connection when s.keepAlive
+// is set instead of dispatching a fresh one per dial.
+func (s *DoHNameServer) dialRemoteQUIC(ctx context.Context, dest net.Destination) (net.PacketConn, error) {
+	if !s.keepAlive {
+		return s.dispatchPacketStream(ctx, dest)
+	}
+
+	s.connAccess.Lock()
+	defer s.connAccess.Unlock()
+	if s.pinnedPacketConn != nil {
+		return s.pinnedPacketConn, nil
+	}
+
+	pconn, err := s.dispatchPacketStream(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	s.pinnedPacketConn = &pinnedPacketConn{PacketConn: pconn, onClose: func() {
+		s.connAccess.Lock()
+		s.pinnedPacketConn = nil
+		s.connAccess.Unlock()
+	}}
+	return s.pinnedPacketConn, nil
+}
+
+func (s *DoHNameServer) dispatchPacketStream(ctx context.Context, dest net.Destination) (net.PacketConn, error) {
+	link, err := s.dispatcher.Dispatch(toDnsContext(ctx, s.dohURL), dest)
+	if err != nil {
+		return nil, err
+	}
+	return &packetConnOverStream{
+		conn: cnc.NewConnection(
+			cnc.ConnectionInputMulti(link.Writer),
+			cnc.ConnectionOutputMulti(link.Reader),
+		),
+		dest: dest,
+	}, nil
+}
+
+// pinnedPacketConn notifies the owning DoHNameServer when the transport
+// closes it, so the next dial knows to establish a fresh connection.
+type pinnedPacketConn struct {
+	net.PacketConn
+	onClose func()
+}
+
+func (c *pinnedPacketConn) Close() error {
+	c.onClose()
+	return c.PacketConn.Close()
+}
+
+// dialLocalQUIC dials a real UDP socket for local HTTP/3 resolving.
+func (s *DoHNameServer) dialLocalQUIC(ctx context.Context, dest net.Destination) (net.PacketConn, error) {
+	conn, err := internet.DialSystem(ctx, dest, nil)
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(net.PacketConn)
+	if !ok {
+		return nil, newError("system dial for ", dest, " did not return a packet connection")
+	}
+	return pc, nil
+}
+
+// newH3Transport builds an HTTP/3 RoundTripper with a session-ticket cache
+// so repeat queries to the same server can resume with 0-RTT.
+func (s *DoHNameServer) newH3Transport(dial func(ctx context.Context, dest net.Destination) (net.PacketConn, error)) *http3.RoundTripper {
+	return &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		},
+		QUICConfig: &quic.Config{
+			TokenStore: quic.NewLRUTokenStore(4, 8),
+		},
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			dest, err := net.ParseDestination("udp:" + addr)
+			if err != nil {
+				return nil, err
+			}
+			pconn, err := dial(ctx, dest)
+			if err != nil {
+				return nil, err
+			}
+			return quic.DialEarly(ctx, pconn, dest.UDPAddr(), tlsCfg, cfg)
+		},
+	}
+}
+
 func baseDOHNameServer(url *url.URL, prefix string) *DoHNameServer {
+	useH3 := url.Scheme == "h3" || url.Query().Get("h3") == "1"
+	if url.Scheme == "h3" {
+		url.Scheme = "https"
+	}
+
 	s := &DoHNameServer{
 		ips:    make(map[string]*record),
 		pub:    pubsub.NewService(),
 		name:   prefix + "//" + url.Host,
 		dohURL: url.String(),
+		useH3:  useH3,
 	}
 	s.cleanup = &task.Periodic{
 		Interval: time.Minute,
@@ -230,7 +487,11 @@ func (s *DoHNameServer) sendQuery(ctx context.Context, domain string, clientIP n
 		return
 	}
 
-	reqs := buildReqMsgs(domain, option, s.newReqID, genEDNS0Options(clientIP))
+	if s.clientIP != nil {
+		clientIP = s.clientIP
+	}
+
+	reqs := buildReqMsgs(domain, applyQueryStrategy(option, s.queryStrategy), s.newReqID, genEDNS0Options(clientIP))
 
 	var deadline time.Time
 	if d, ok := ctx.Deadline(); ok {
@@ -245,9 +506,17 @@ func (s *DoHNameServer) sendQuery(ctx context.Context, domain string, clientIP n
 			// may cause reqs all aborted if any one encounter an error
 			dnsCtx := ctx
 
-			// reserve internal dns server requested Inbound
+			// reserve internal dns server requested Inbound, stamping this
+			// server's tag onto a copy of it rather than replacing it outright
 			if inbound := session.InboundFromContext(ctx); inbound != nil {
+				if s.tag != "" {
+					taggedInbound := *inbound
+					taggedInbound.Tag = s.tag
+					inbound = &taggedInbound
+				}
 				dnsCtx = session.ContextWithInbound(dnsCtx, inbound)
+			} else if s.tag != "" {
+				dnsCtx = session.ContextWithInbound(dnsCtx, &session.Inbound{Tag: s.tag})
 			}
 
 			dnsCtx = session.ContextWithContent(dnsCtx, &session.Content{
@@ -0,0 +1,500 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/dharak36/xray-core/common"
+	"github.com/dharak36/xray-core/common/log"
+	"github.com/dharak36/xray-core/common/net"
+	"github.com/dharak36/xray-core/common/net/cnc"
+	"github.com/dharak36/xray-core/common/protocol/dns"
+	"github.com/dharak36/xray-core/common/session"
+	"github.com/dharak36/xray-core/common/signal/pubsub"
+	"github.com/dharak36/xray-core/common/task"
+	dns_feature "github.com/dharak36/xray-core/features/dns"
+	"github.com/dharak36/xray-core/features/routing"
+	"github.com/dharak36/xray-core/transport/internet"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// nextProtoDoQ is the ALPN token for DNS-over-QUIC, as fixed by RFC 9250.
+const nextProtoDoQ = "doq"
+
+// QUICNameServer implements DNS-over-QUIC (RFC 9250). Every query is sent on
+// its own bidirectional stream of a shared, 0-RTT-capable QUIC connection,
+// framed with the same two-byte length prefix used by DoT/DoTCP. Caching,
+// cleanup and pub/sub plumbing mirror DoHNameServer.
+//
+// TODO: not yet reachable from any config — nothing registers a "quic://"
+// or "quic+local://" scheme against NewQUICNameServer/NewQUICLocalNameServer
+// in the nameserver factory, since that file lives outside this slice of
+// the repo.
+type QUICNameServer struct {
+	sync.RWMutex
+	ips     map[string]*record
+	pub     *pubsub.Service
+	cleanup *task.Periodic
+	// seq is a monotonic counter used purely to order cached answers by
+	// recency (see isNewer); it is independent of the wire DNS message ID,
+	// which RFC 9250 requires to stay 0 on every DoQ query.
+	seq         uint32
+	name        string
+	destination net.Destination
+	dispatcher  routing.Dispatcher
+	tlsConfig   *tls.Config
+
+	connAccess sync.Mutex
+	conn       quic.Connection
+}
+
+// NewQUICNameServer creates a DNS-over-QUIC server object for remote resolving via the dispatcher.
+func NewQUICNameServer(url *url.URL, dispatcher routing.Dispatcher) (*QUICNameServer, error) {
+	newError("DNS: created Remote DNS-over-QUIC client for ", url.String()).AtInfo().WriteToLog()
+
+	s, err := baseQUICNameServer(url, "DOQ")
+	if err != nil {
+		return nil, err
+	}
+	s.dispatcher = dispatcher
+	return s, nil
+}
+
+// NewQUICLocalNameServer creates a DNS-over-QUIC server object for local resolving.
+func NewQUICLocalNameServer(url *url.URL) (*QUICNameServer, error) {
+	s, err := baseQUICNameServer(url, "DOQL")
+	if err != nil {
+		return nil, err
+	}
+	newError("DNS: created Local DNS-over-QUIC client for ", url.String()).AtInfo().WriteToLog()
+	return s, nil
+}
+
+func baseQUICNameServer(url *url.URL, prefix string) (*QUICNameServer, error) {
+	port := net.Port(853)
+	if url.Port() != "" {
+		p, err := net.PortFromString(url.Port())
+		if err != nil {
+			return nil, err
+		}
+		port = p
+	}
+	dest := net.Destination{
+		Network: net.Network_UDP,
+		Address: net.ParseAddress(url.Hostname()),
+		Port:    port,
+	}
+
+	s := &QUICNameServer{
+		ips:         make(map[string]*record),
+		pub:         pubsub.NewService(),
+		name:        prefix + "//" + dest.NetAddr(),
+		destination: dest,
+		tlsConfig: &tls.Config{
+			ServerName:         url.Hostname(),
+			NextProtos:         []string{nextProtoDoQ},
+			ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		},
+	}
+	s.cleanup = &task.Periodic{
+		Interval: time.Minute,
+		Execute:  s.Cleanup,
+	}
+	return s, nil
+}
+
+// Name implements Server.
+func (s *QUICNameServer) Name() string {
+	return s.name
+}
+
+// Cleanup clears expired items from cache.
+func (s *QUICNameServer) Cleanup() error {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.ips) == 0 {
+		return newError("nothing to do. stopping...")
+	}
+
+	for domain, record := range s.ips {
+		if record.A != nil && record.A.Expire.Before(now) {
+			record.A = nil
+		}
+		if record.AAAA != nil && record.AAAA.Expire.Before(now) {
+			record.AAAA = nil
+		}
+
+		if record.A == nil && record.AAAA == nil {
+			newError(s.name, " cleanup ", domain).AtDebug().WriteToLog()
+			delete(s.ips, domain)
+		} else {
+			s.ips[domain] = record
+		}
+	}
+
+	if len(s.ips) == 0 {
+		s.ips = make(map[string]*record)
+	}
+
+	return nil
+}
+
+// nextSeq returns the next value of the internal cache-ordering counter
+// described on QUICNameServer.seq.
+func (s *QUICNameServer) nextSeq() uint16 {
+	return uint16(atomic.AddUint32(&s.seq, 1))
+}
+
+func (s *QUICNameServer) updateIP(req *dnsRequest, ipRec *IPRecord) {
+	elapsed := time.Since(req.start)
+
+	s.Lock()
+	rec, found := s.ips[req.domain]
+	if !found {
+		rec = &record{}
+	}
+	updated := false
+
+	switch req.reqType {
+	case dnsmessage.TypeA:
+		if isNewer(rec.A, ipRec) {
+			rec.A = ipRec
+			updated = true
+		}
+	case dnsmessage.TypeAAAA:
+		addr := make([]net.Address, 0, len(ipRec.IP))
+		for _, ip := range ipRec.IP {
+			if len(ip.IP()) == net.IPv6len {
+				addr = append(addr, ip)
+			}
+		}
+		ipRec.IP = addr
+		if isNewer(rec.AAAA, ipRec) {
+			rec.AAAA = ipRec
+			updated = true
+		}
+	}
+	newError(s.name, " got answer: ", req.domain, " ", req.reqType, " -> ", ipRec.IP, " ", elapsed).AtInfo().WriteToLog()
+
+	if updated {
+		s.ips[req.domain] = rec
+	}
+	switch req.reqType {
+	case dnsmessage.TypeA:
+		s.pub.Publish(req.domain+"4", nil)
+	case dnsmessage.TypeAAAA:
+		s.pub.Publish(req.domain+"6", nil)
+	}
+	s.Unlock()
+	common.Must(s.cleanup.Start())
+}
+
+func (s *QUICNameServer) sendQuery(ctx context.Context, domain string, clientIP net.IP, option dns_feature.IPOption) {
+	newError(s.name, " querying: ", domain).AtInfo().WriteToLog(session.ExportIDToError(ctx))
+
+	if s.name+"." == "DOQ//"+domain {
+		newError(s.name, " tries to resolve itself! Use IP or set \"hosts\" instead.").AtError().WriteToLog(session.ExportIDToError(ctx))
+		return
+	}
+
+	// RFC 9250 §4.2.1: the DNS Message ID MUST be 0 on DoQ queries, since each
+	// query already has its own bidirectional stream for correlation.
+	reqs := buildReqMsgs(domain, option, func() uint16 { return 0 }, genEDNS0Options(clientIP))
+
+	var deadline time.Time
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d
+	} else {
+		deadline = time.Now().Add(time.Second * 5)
+	}
+
+	for _, req := range reqs {
+		// Assigned before dispatch, and independent of the wire message ID
+		// (always 0 for DoQ): this is what isNewer uses to keep a late/stale
+		// response from clobbering a fresher cached answer.
+		seq := s.nextSeq()
+		go func(r *dnsRequest, seq uint16) {
+			dnsCtx := ctx
+
+			if inbound := session.InboundFromContext(ctx); inbound != nil {
+				dnsCtx = session.ContextWithInbound(dnsCtx, inbound)
+			}
+
+			dnsCtx = session.ContextWithContent(dnsCtx, &session.Content{
+				Protocol:       "quic",
+				SkipDNSResolve: true,
+			})
+
+			var cancel context.CancelFunc
+			dnsCtx, cancel = context.WithDeadline(dnsCtx, deadline)
+			defer cancel()
+
+			b, err := dns.PackMessage(r.msg)
+			if err != nil {
+				newError("failed to pack dns query for ", domain).Base(err).AtError().WriteToLog()
+				return
+			}
+
+			resp, err := s.doqQuery(dnsCtx, b.Bytes())
+			if err != nil {
+				newError("failed to retrieve response for ", domain).Base(err).AtError().WriteToLog()
+				return
+			}
+
+			rec, err := parseResponse(resp)
+			if err != nil {
+				newError("failed to handle DOQ response for ", domain).Base(err).AtError().WriteToLog()
+				return
+			}
+			// The wire message ID on rec is always 0 (see buildReqMsgs call
+			// above); overwrite it with our own sequence number so isNewer
+			// still orders cached answers by recency.
+			rec.ReqID = seq
+			s.updateIP(r, rec)
+		}(req, seq)
+	}
+}
+
+// doqQuery sends a single DNS message over its own bidirectional QUIC stream
+// and returns the (length-prefixed on the wire, unwrapped here) response.
+func (s *QUICNameServer) doqQuery(ctx context.Context, msg []byte) ([]byte, error) {
+	stream, err := s.openStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	if d, ok := ctx.Deadline(); ok {
+		if err := stream.SetDeadline(d); err != nil {
+			return nil, err
+		}
+	}
+
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(msg)))
+	if _, err := stream.Write(lenBuf[:]); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(msg); err != nil {
+		return nil, err
+	}
+	// RFC 9250 requires the client to signal it has no more data to send on
+	// the stream; quic-go's Close() only closes the write side.
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var respLenBuf [2]byte
+	if _, err := io.ReadFull(stream, respLenBuf[:]); err != nil {
+		return nil, err
+	}
+	respLen := binary.BigEndian.Uint16(respLenBuf[:])
+	resp := make([]byte, respLen)
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// openStream returns a bidirectional stream over a shared QUIC connection,
+// dialing (or redialing, after a previous connection died) as needed.
+func (s *QUICNameServer) openStream(ctx context.Context) (quic.Stream, error) {
+	s.connAccess.Lock()
+	defer s.connAccess.Unlock()
+
+	if s.conn != nil {
+		if stream, err := s.conn.OpenStreamSync(ctx); err == nil {
+			return stream, nil
+		}
+		s.conn = nil
+	}
+
+	packetConn, err := s.dialPacketConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	quicConfig := &quic.Config{
+		TokenStore: quic.NewLRUTokenStore(4, 8),
+	}
+	conn, err := quic.DialEarly(ctx, packetConn, s.destination.UDPAddr(), s.tlsConfig, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return conn.OpenStreamSync(ctx)
+}
+
+func (s *QUICNameServer) dialPacketConn(ctx context.Context) (net.PacketConn, error) {
+	if s.dispatcher != nil {
+		link, err := s.dispatcher.Dispatch(toDnsContext(ctx, s.name), s.destination)
+		if err != nil {
+			return nil, err
+		}
+		return &packetConnOverStream{
+			conn: cnc.NewConnection(
+				cnc.ConnectionInputMulti(link.Writer),
+				cnc.ConnectionOutputMulti(link.Reader),
+			),
+			dest: s.destination,
+		}, nil
+	}
+
+	conn, err := internet.DialSystem(ctx, s.destination, nil)
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(net.PacketConn)
+	if !ok {
+		return nil, newError("system dial for ", s.destination, " did not return a packet connection")
+	}
+	return pc, nil
+}
+
+// packetConnOverStream carries UDP-shaped datagrams over a dispatched,
+// stream-oriented link so quic-go can drive a QUIC connection through it.
+// Every datagram is framed with a two-byte big-endian length prefix.
+type packetConnOverStream struct {
+	conn net.Conn
+	dest net.Destination
+}
+
+func (p *packetConnOverStream) ReadFrom(b []byte) (int, net.Addr, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(p.conn, lenBuf[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(lenBuf[:]))
+	if n > len(b) {
+		return 0, nil, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(p.conn, b[:n]); err != nil {
+		return 0, nil, err
+	}
+	return n, p.dest.UDPAddr(), nil
+}
+
+func (p *packetConnOverStream) WriteTo(b []byte, _ net.Addr) (int, error) {
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(b)))
+	if _, err := p.conn.Write(lenBuf[:]); err != nil {
+		return 0, err
+	}
+	return p.conn.Write(b)
+}
+
+func (p *packetConnOverStream) Close() error                       { return p.conn.Close() }
+func (p *packetConnOverStream) LocalAddr() net.Addr                { return p.conn.LocalAddr() }
+func (p *packetConnOverStream) SetDeadline(t time.Time) error      { return p.conn.SetDeadline(t) }
+func (p *packetConnOverStream) SetReadDeadline(t time.Time) error  { return p.conn.SetReadDeadline(t) }
+func (p *packetConnOverStream) SetWriteDeadline(t time.Time) error { return p.conn.SetWriteDeadline(t) }
+
+func (s *QUICNameServer) findIPsForDomain(domain string, option dns_feature.IPOption) ([]net.IP, error) {
+	s.RLock()
+	record, found := s.ips[domain]
+	s.RUnlock()
+
+	if !found {
+		return nil, errRecordNotFound
+	}
+
+	var err4 error
+	var err6 error
+	var ips []net.Address
+	var ip6 []net.Address
+
+	if option.IPv4Enable {
+		ips, err4 = record.A.getIPs()
+	}
+
+	if option.IPv6Enable {
+		ip6, err6 = record.AAAA.getIPs()
+		ips = append(ips, ip6...)
+	}
+
+	if len(ips) > 0 {
+		return toNetIP(ips)
+	}
+
+	if err4 != nil {
+		return nil, err4
+	}
+
+	if err6 != nil {
+		return nil, err6
+	}
+
+	if (option.IPv4Enable && record.A != nil) || (option.IPv6Enable && record.AAAA != nil) {
+		return nil, dns_feature.ErrEmptyResponse
+	}
+
+	return nil, errRecordNotFound
+}
+
+// QueryIP implements Server.
+func (s *QUICNameServer) QueryIP(ctx context.Context, domain string, clientIP net.IP, option dns_feature.IPOption, disableCache bool) ([]net.IP, error) { // nolint: dupl
+	fqdn := Fqdn(domain)
+
+	if disableCache {
+		newError("DNS cache is disabled. Querying IP for ", domain, " at ", s.name).AtDebug().WriteToLog()
+	} else {
+		ips, err := s.findIPsForDomain(fqdn, option)
+		if err != errRecordNotFound {
+			newError(s.name, " cache HIT ", domain, " -> ", ips).Base(err).AtDebug().WriteToLog()
+			log.Record(&log.DNSLog{Server: s.name, Domain: domain, Result: ips, Status: log.DNSCacheHit, Elapsed: 0, Error: err})
+			return ips, err
+		}
+	}
+
+	var sub4, sub6 *pubsub.Subscriber
+	if option.IPv4Enable {
+		sub4 = s.pub.Subscribe(fqdn + "4")
+		defer sub4.Close()
+	}
+	if option.IPv6Enable {
+		sub6 = s.pub.Subscribe(fqdn + "6")
+		defer sub6.Close()
+	}
+	done := make(chan interface{})
+	go func() {
+		if sub4 != nil {
+			select {
+			case <-sub4.Wait():
+			case <-ctx.Done():
+			}
+		}
+		if sub6 != nil {
+			select {
+			case <-sub6.Wait():
+			case <-ctx.Done():
+			}
+		}
+		close(done)
+	}()
+	s.sendQuery(ctx, fqdn, clientIP, option)
+	start := time.Now()
+
+	for {
+		ips, err := s.findIPsForDomain(fqdn, option)
+		if err != errRecordNotFound {
+			log.Record(&log.DNSLog{Server: s.name, Domain: domain, Result: ips, Status: log.DNSQueried, Elapsed: time.Since(start), Error: err})
+			return ips, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-done:
+		}
+	}
+}
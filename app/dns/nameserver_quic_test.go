@@ -0,0 +1,112 @@
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dharak36/xray-core/common/net"
+	"github.com/dharak36/xray-core/common/signal/pubsub"
+	"github.com/dharak36/xray-core/common/task"
+	dns_feature "github.com/dharak36/xray-core/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestQUICNameServer() *QUICNameServer {
+	s := &QUICNameServer{
+		ips:  make(map[string]*record),
+		pub:  pubsub.NewService(),
+		name: "DOQ//test",
+	}
+	s.cleanup = &task.Periodic{
+		Interval: time.Minute,
+		Execute:  s.Cleanup,
+	}
+	return s
+}
+
+func TestQUICFindIPsForDomainNotFound(t *testing.T) {
+	s := newTestQUICNameServer()
+
+	if _, err := s.findIPsForDomain("example.com.", dns_feature.IPOption{IPv4Enable: true}); err != errRecordNotFound {
+		t.Fatalf("got error %v, want errRecordNotFound", err)
+	}
+}
+
+func TestQUICUpdateIPAndFindIPsForDomain(t *testing.T) {
+	s := newTestQUICNameServer()
+	domain := "example.com."
+
+	v4 := net.ParseAddress("8.8.8.8")
+	s.updateIP(&dnsRequest{start: time.Now(), domain: domain, reqType: dnsmessage.TypeA}, &IPRecord{
+		ReqID:  1,
+		IP:     []net.Address{v4},
+		Expire: time.Now().Add(time.Hour),
+		RCode:  dnsmessage.RCodeSuccess,
+	})
+
+	ips, err := s.findIPsForDomain(domain, dns_feature.IPOption{IPv4Enable: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || ips[0].String() != "8.8.8.8" {
+		t.Fatalf("got %v, want [8.8.8.8]", ips)
+	}
+
+	// AAAA was never populated, so asking for it alone is still a miss.
+	if _, err := s.findIPsForDomain(domain, dns_feature.IPOption{IPv6Enable: true}); err != errRecordNotFound {
+		t.Fatalf("got error %v, want errRecordNotFound for AAAA", err)
+	}
+}
+
+func TestQUICUpdateIPFiltersAAAAToIPv6(t *testing.T) {
+	s := newTestQUICNameServer()
+	domain := "example.com."
+
+	v4 := net.ParseAddress("8.8.8.8")
+	v6 := net.ParseAddress("2001:4860:4860::8888")
+	s.updateIP(&dnsRequest{start: time.Now(), domain: domain, reqType: dnsmessage.TypeAAAA}, &IPRecord{
+		ReqID:  1,
+		IP:     []net.Address{v4, v6},
+		Expire: time.Now().Add(time.Hour),
+		RCode:  dnsmessage.RCodeSuccess,
+	})
+
+	ips, err := s.findIPsForDomain(domain, dns_feature.IPOption{IPv6Enable: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || ips[0].String() != "2001:4860:4860::8888" {
+		t.Fatalf("got %v, want only the IPv6 address", ips)
+	}
+}
+
+func TestQUICUpdateIPStaleRequestDoesNotOverwrite(t *testing.T) {
+	s := newTestQUICNameServer()
+	domain := "example.com."
+
+	newIP := net.ParseAddress("1.1.1.1")
+	oldIP := net.ParseAddress("8.8.8.8")
+
+	s.updateIP(&dnsRequest{start: time.Now(), domain: domain, reqType: dnsmessage.TypeA}, &IPRecord{
+		ReqID:  2,
+		IP:     []net.Address{newIP},
+		Expire: time.Now().Add(time.Hour),
+		RCode:  dnsmessage.RCodeSuccess,
+	})
+	// A reply for an older, already-superseded request must not clobber the
+	// newer cached answer.
+	s.updateIP(&dnsRequest{start: time.Now(), domain: domain, reqType: dnsmessage.TypeA}, &IPRecord{
+		ReqID:  1,
+		IP:     []net.Address{oldIP},
+		Expire: time.Now().Add(time.Hour),
+		RCode:  dnsmessage.RCodeSuccess,
+	})
+
+	ips, err := s.findIPsForDomain(domain, dns_feature.IPOption{IPv4Enable: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || ips[0].String() != "1.1.1.1" {
+		t.Fatalf("got %v, want the newer answer [1.1.1.1] to survive", ips)
+	}
+}
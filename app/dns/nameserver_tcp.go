@@ -0,0 +1,474 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dharak36/xray-core/common"
+	"github.com/dharak36/xray-core/common/log"
+	"github.com/dharak36/xray-core/common/net"
+	"github.com/dharak36/xray-core/common/net/cnc"
+	"github.com/dharak36/xray-core/common/protocol/dns"
+	"github.com/dharak36/xray-core/common/session"
+	"github.com/dharak36/xray-core/common/signal/pubsub"
+	"github.com/dharak36/xray-core/common/task"
+	dns_feature "github.com/dharak36/xray-core/features/dns"
+	"github.com/dharak36/xray-core/features/routing"
+	"github.com/dharak36/xray-core/transport/internet"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// tcpConnIdleTimeout is how long an idle pooled connection is kept around
+// before it is closed, mirroring http.Transport's IdleConnTimeout used by
+// DoHNameServer.
+const tcpConnIdleTimeout = 90 * time.Second
+
+// TCPNameServer implements DNS over plain TCP (RFC 7766), with the same
+// two-byte length-prefixed wire format as DoT/DoTCP. It keeps a small pool
+// of idle connections so repeated queries don't pay a fresh TCP handshake
+// every time.
+//
+// TODO: not yet reachable from any config — nothing registers a "tcp://"
+// or "tcp+local://" scheme against NewTCPNameServer/NewTCPLocalNameServer
+// in the nameserver factory, since that file lives outside this slice of
+// the repo.
+type TCPNameServer struct {
+	sync.RWMutex
+	ips         map[string]*record
+	pub         *pubsub.Service
+	cleanup     *task.Periodic
+	reqID       uint32
+	name        string
+	destination net.Destination
+	dispatcher  routing.Dispatcher
+
+	poolAccess sync.Mutex
+	pool       []*pooledConn
+}
+
+type pooledConn struct {
+	net.Conn
+	lastUsed time.Time
+}
+
+// NewTCPNameServer creates a DNS-over-TCP server object for remote resolving via the dispatcher.
+func NewTCPNameServer(url *url.URL, dispatcher routing.Dispatcher) (*TCPNameServer, error) {
+	newError("DNS: created Remote TCP client for ", url.String()).AtInfo().WriteToLog()
+
+	s, err := baseTCPNameServer(url, "TCP")
+	if err != nil {
+		return nil, err
+	}
+	s.dispatcher = dispatcher
+	return s, nil
+}
+
+// NewTCPLocalNameServer creates a DNS-over-TCP server object for local resolving.
+func NewTCPLocalNameServer(url *url.URL) (*TCPNameServer, error) {
+	s, err := baseTCPNameServer(url, "TCPL")
+	if err != nil {
+		return nil, err
+	}
+	newError("DNS: created Local TCP client for ", url.String()).AtInfo().WriteToLog()
+	return s, nil
+}
+
+func baseTCPNameServer(url *url.URL, prefix string) (*TCPNameServer, error) {
+	port := net.Port(53)
+	if url.Port() != "" {
+		p, err := net.PortFromString(url.Port())
+		if err != nil {
+			return nil, err
+		}
+		port = p
+	}
+	dest := net.Destination{
+		Network: net.Network_TCP,
+		Address: net.ParseAddress(url.Hostname()),
+		Port:    port,
+	}
+
+	s := &TCPNameServer{
+		ips:         make(map[string]*record),
+		pub:         pubsub.NewService(),
+		name:        prefix + "//" + dest.NetAddr(),
+		destination: dest,
+	}
+	s.cleanup = &task.Periodic{
+		Interval: time.Minute,
+		Execute:  s.Cleanup,
+	}
+	return s, nil
+}
+
+// Name implements Server.
+func (s *TCPNameServer) Name() string {
+	return s.name
+}
+
+// Cleanup clears expired items from cache and prunes idle pooled connections.
+func (s *TCPNameServer) Cleanup() error {
+	now := time.Now()
+	s.Lock()
+
+	if len(s.ips) == 0 {
+		s.Unlock()
+	} else {
+		for domain, record := range s.ips {
+			if record.A != nil && record.A.Expire.Before(now) {
+				record.A = nil
+			}
+			if record.AAAA != nil && record.AAAA.Expire.Before(now) {
+				record.AAAA = nil
+			}
+
+			if record.A == nil && record.AAAA == nil {
+				newError(s.name, " cleanup ", domain).AtDebug().WriteToLog()
+				delete(s.ips, domain)
+			} else {
+				s.ips[domain] = record
+			}
+		}
+
+		if len(s.ips) == 0 {
+			s.ips = make(map[string]*record)
+		}
+		s.Unlock()
+	}
+
+	s.pruneIdleConns(now)
+	return nil
+}
+
+func (s *TCPNameServer) pruneIdleConns(now time.Time) {
+	s.poolAccess.Lock()
+	defer s.poolAccess.Unlock()
+
+	live := s.pool[:0]
+	for _, c := range s.pool {
+		if now.Sub(c.lastUsed) > tcpConnIdleTimeout {
+			c.Conn.Close()
+			continue
+		}
+		live = append(live, c)
+	}
+	s.pool = live
+}
+
+func (s *TCPNameServer) updateIP(req *dnsRequest, ipRec *IPRecord) {
+	elapsed := time.Since(req.start)
+
+	s.Lock()
+	rec, found := s.ips[req.domain]
+	if !found {
+		rec = &record{}
+	}
+	updated := false
+
+	switch req.reqType {
+	case dnsmessage.TypeA:
+		if isNewer(rec.A, ipRec) {
+			rec.A = ipRec
+			updated = true
+		}
+	case dnsmessage.TypeAAAA:
+		addr := make([]net.Address, 0, len(ipRec.IP))
+		for _, ip := range ipRec.IP {
+			if len(ip.IP()) == net.IPv6len {
+				addr = append(addr, ip)
+			}
+		}
+		ipRec.IP = addr
+		if isNewer(rec.AAAA, ipRec) {
+			rec.AAAA = ipRec
+			updated = true
+		}
+	}
+	newError(s.name, " got answer: ", req.domain, " ", req.reqType, " -> ", ipRec.IP, " ", elapsed).AtInfo().WriteToLog()
+
+	if updated {
+		s.ips[req.domain] = rec
+	}
+	switch req.reqType {
+	case dnsmessage.TypeA:
+		s.pub.Publish(req.domain+"4", nil)
+	case dnsmessage.TypeAAAA:
+		s.pub.Publish(req.domain+"6", nil)
+	}
+	s.Unlock()
+	common.Must(s.cleanup.Start())
+}
+
+func (s *TCPNameServer) newReqID() uint16 {
+	return uint16(atomic.AddUint32(&s.reqID, 1))
+}
+
+func (s *TCPNameServer) sendQuery(ctx context.Context, domain string, clientIP net.IP, option dns_feature.IPOption) {
+	newError(s.name, " querying: ", domain).AtInfo().WriteToLog(session.ExportIDToError(ctx))
+
+	if s.name+"." == "TCP//"+domain {
+		newError(s.name, " tries to resolve itself! Use IP or set \"hosts\" instead.").AtError().WriteToLog(session.ExportIDToError(ctx))
+		return
+	}
+
+	reqs := buildReqMsgs(domain, option, s.newReqID, genEDNS0Options(clientIP))
+
+	var deadline time.Time
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d
+	} else {
+		deadline = time.Now().Add(time.Second * 5)
+	}
+
+	for _, req := range reqs {
+		go func(r *dnsRequest) {
+			dnsCtx := ctx
+
+			if inbound := session.InboundFromContext(ctx); inbound != nil {
+				dnsCtx = session.ContextWithInbound(dnsCtx, inbound)
+			}
+
+			dnsCtx = session.ContextWithContent(dnsCtx, &session.Content{
+				Protocol:       "dns",
+				SkipDNSResolve: true,
+			})
+
+			var cancel context.CancelFunc
+			dnsCtx, cancel = context.WithDeadline(dnsCtx, deadline)
+			defer cancel()
+
+			b, err := dns.PackMessage(r.msg)
+			if err != nil {
+				newError("failed to pack dns query for ", domain).Base(err).AtError().WriteToLog()
+				return
+			}
+
+			resp, err := s.tcpQuery(dnsCtx, b.Bytes())
+			if err != nil {
+				newError("failed to retrieve response for ", domain).Base(err).AtError().WriteToLog()
+				return
+			}
+
+			rec, err := parseResponse(resp)
+			if err != nil {
+				newError("failed to handle TCP response for ", domain).Base(err).AtError().WriteToLog()
+				return
+			}
+			s.updateIP(r, rec)
+		}(req)
+	}
+}
+
+// tcpQuery writes a single length-prefixed DNS message and reads back the
+// length-prefixed answer. If a pooled connection fails, it retries once on
+// the next connection getConn hands out: another pooled one if the pool is
+// not empty, otherwise a freshly dialed one.
+func (s *TCPNameServer) tcpQuery(ctx context.Context, msg []byte) ([]byte, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, pooled, err := s.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if d, ok := ctx.Deadline(); ok {
+			if err := conn.SetDeadline(d); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		resp, err := writeReadTCPMessage(conn, msg)
+		if err != nil {
+			conn.Close()
+			if pooled {
+				continue
+			}
+			return nil, err
+		}
+
+		s.putConn(conn)
+		return resp, nil
+	}
+	return nil, newError("failed to query ", s.name, " on two pooled connections")
+}
+
+func writeReadTCPMessage(conn net.Conn, msg []byte) ([]byte, error) {
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(msg)))
+	if _, err := conn.Write(lenBuf[:]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var respLenBuf [2]byte
+	if _, err := io.ReadFull(conn, respLenBuf[:]); err != nil {
+		return nil, err
+	}
+	respLen := binary.BigEndian.Uint16(respLenBuf[:])
+	resp := make([]byte, respLen)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s *TCPNameServer) getConn(ctx context.Context) (net.Conn, bool, error) {
+	s.poolAccess.Lock()
+	if n := len(s.pool); n > 0 {
+		c := s.pool[n-1]
+		s.pool = s.pool[:n-1]
+		s.poolAccess.Unlock()
+		return c.Conn, true, nil
+	}
+	s.poolAccess.Unlock()
+
+	conn, err := s.dial(ctx)
+	return conn, false, err
+}
+
+func (s *TCPNameServer) putConn(conn net.Conn) {
+	s.poolAccess.Lock()
+	defer s.poolAccess.Unlock()
+	s.pool = append(s.pool, &pooledConn{Conn: conn, lastUsed: time.Now()})
+}
+
+func (s *TCPNameServer) dial(ctx context.Context) (net.Conn, error) {
+	if s.dispatcher != nil {
+		link, err := s.dispatcher.Dispatch(toDnsContext(ctx, s.name), s.destination)
+		if err != nil {
+			return nil, err
+		}
+
+		cc := common.ChainedClosable{}
+		if cw, ok := link.Writer.(common.Closable); ok {
+			cc = append(cc, cw)
+		}
+		if cr, ok := link.Reader.(common.Closable); ok {
+			cc = append(cc, cr)
+		}
+		return cnc.NewConnection(
+			cnc.ConnectionInputMulti(link.Writer),
+			cnc.ConnectionOutputMulti(link.Reader),
+			cnc.ConnectionOnClose(cc),
+		), nil
+	}
+
+	conn, err := internet.DialSystem(ctx, s.destination, nil)
+	if err != nil {
+		return nil, err
+	}
+	log.Record(&log.AccessMessage{
+		From:   "DNS",
+		To:     s.name,
+		Status: log.AccessAccepted,
+		Detour: "local",
+	})
+	return conn, nil
+}
+
+func (s *TCPNameServer) findIPsForDomain(domain string, option dns_feature.IPOption) ([]net.IP, error) {
+	s.RLock()
+	record, found := s.ips[domain]
+	s.RUnlock()
+
+	if !found {
+		return nil, errRecordNotFound
+	}
+
+	var err4 error
+	var err6 error
+	var ips []net.Address
+	var ip6 []net.Address
+
+	if option.IPv4Enable {
+		ips, err4 = record.A.getIPs()
+	}
+
+	if option.IPv6Enable {
+		ip6, err6 = record.AAAA.getIPs()
+		ips = append(ips, ip6...)
+	}
+
+	if len(ips) > 0 {
+		return toNetIP(ips)
+	}
+
+	if err4 != nil {
+		return nil, err4
+	}
+
+	if err6 != nil {
+		return nil, err6
+	}
+
+	if (option.IPv4Enable && record.A != nil) || (option.IPv6Enable && record.AAAA != nil) {
+		return nil, dns_feature.ErrEmptyResponse
+	}
+
+	return nil, errRecordNotFound
+}
+
+// QueryIP implements Server.
+func (s *TCPNameServer) QueryIP(ctx context.Context, domain string, clientIP net.IP, option dns_feature.IPOption, disableCache bool) ([]net.IP, error) { // nolint: dupl
+	fqdn := Fqdn(domain)
+
+	if disableCache {
+		newError("DNS cache is disabled. Querying IP for ", domain, " at ", s.name).AtDebug().WriteToLog()
+	} else {
+		ips, err := s.findIPsForDomain(fqdn, option)
+		if err != errRecordNotFound {
+			newError(s.name, " cache HIT ", domain, " -> ", ips).Base(err).AtDebug().WriteToLog()
+			log.Record(&log.DNSLog{Server: s.name, Domain: domain, Result: ips, Status: log.DNSCacheHit, Elapsed: 0, Error: err})
+			return ips, err
+		}
+	}
+
+	var sub4, sub6 *pubsub.Subscriber
+	if option.IPv4Enable {
+		sub4 = s.pub.Subscribe(fqdn + "4")
+		defer sub4.Close()
+	}
+	if option.IPv6Enable {
+		sub6 = s.pub.Subscribe(fqdn + "6")
+		defer sub6.Close()
+	}
+	done := make(chan interface{})
+	go func() {
+		if sub4 != nil {
+			select {
+			case <-sub4.Wait():
+			case <-ctx.Done():
+			}
+		}
+		if sub6 != nil {
+			select {
+			case <-sub6.Wait():
+			case <-ctx.Done():
+			}
+		}
+		close(done)
+	}()
+	s.sendQuery(ctx, fqdn, clientIP, option)
+	start := time.Now()
+
+	for {
+		ips, err := s.findIPsForDomain(fqdn, option)
+		if err != errRecordNotFound {
+			log.Record(&log.DNSLog{Server: s.name, Domain: domain, Result: ips, Status: log.DNSQueried, Elapsed: time.Since(start), Error: err})
+			return ips, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-done:
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dharak36/xray-core/common/net"
+)
+
+// fakeTCPConn is a minimal net.Conn stand-in used to drive TCPNameServer's
+// connection pool without dialing a real socket.
+type fakeTCPConn struct {
+	readBuf  *bytes.Buffer
+	writeErr error
+	closed   bool
+	deadline time.Time
+}
+
+func (c *fakeTCPConn) Read(b []byte) (int, error) { return c.readBuf.Read(b) }
+func (c *fakeTCPConn) Write(b []byte) (int, error) {
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	return len(b), nil
+}
+func (c *fakeTCPConn) Close() error         { c.closed = true; return nil }
+func (c *fakeTCPConn) LocalAddr() net.Addr  { return nil }
+func (c *fakeTCPConn) RemoteAddr() net.Addr { return nil }
+func (c *fakeTCPConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+func (c *fakeTCPConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeTCPConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func framedResponse(b []byte) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(b)))
+	buf.Write(lenBuf[:])
+	buf.Write(b)
+	return buf
+}
+
+func newTestTCPNameServer() *TCPNameServer {
+	return &TCPNameServer{name: "TCP//test"}
+}
+
+func TestTCPGetConnReturnsPooledConnection(t *testing.T) {
+	s := newTestTCPNameServer()
+	pooled := &fakeTCPConn{readBuf: &bytes.Buffer{}}
+	s.pool = []*pooledConn{{Conn: pooled, lastUsed: time.Now()}}
+
+	conn, fromPool, err := s.getConn(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !fromPool {
+		t.Fatal("expected getConn to report a pooled connection")
+	}
+	if conn != pooled {
+		t.Fatal("getConn did not return the pooled connection")
+	}
+	if len(s.pool) != 0 {
+		t.Fatalf("pool should be drained, got %d entries", len(s.pool))
+	}
+}
+
+func TestTCPPutConnAddsToPool(t *testing.T) {
+	s := newTestTCPNameServer()
+	conn := &fakeTCPConn{readBuf: &bytes.Buffer{}}
+
+	s.putConn(conn)
+
+	if len(s.pool) != 1 || s.pool[0].Conn != conn {
+		t.Fatalf("expected conn to be pooled, got %+v", s.pool)
+	}
+}
+
+func TestTCPPruneIdleConnsClosesStaleConnections(t *testing.T) {
+	s := newTestTCPNameServer()
+	fresh := &fakeTCPConn{readBuf: &bytes.Buffer{}}
+	stale := &fakeTCPConn{readBuf: &bytes.Buffer{}}
+	now := time.Now()
+	s.pool = []*pooledConn{
+		{Conn: fresh, lastUsed: now},
+		{Conn: stale, lastUsed: now.Add(-tcpConnIdleTimeout - time.Second)},
+	}
+
+	s.pruneIdleConns(now)
+
+	if len(s.pool) != 1 || s.pool[0].Conn != fresh {
+		t.Fatalf("expected only the fresh conn to remain, got %+v", s.pool)
+	}
+	if !stale.closed {
+		t.Fatal("expected the stale pooled connection to be closed")
+	}
+	if fresh.closed {
+		t.Fatal("did not expect the fresh pooled connection to be closed")
+	}
+}
+
+func TestTCPQueryRetriesOnStalePooledConnection(t *testing.T) {
+	s := newTestTCPNameServer()
+
+	working := &fakeTCPConn{readBuf: framedResponse([]byte("answer"))}
+	broken := &fakeTCPConn{readBuf: &bytes.Buffer{}, writeErr: errors.New("use of closed network connection")}
+
+	// getConn pops from the back of the pool, so push working first: the
+	// first attempt pops broken, the retry after its failure pops working.
+	s.pool = []*pooledConn{
+		{Conn: working, lastUsed: time.Now()},
+		{Conn: broken, lastUsed: time.Now()},
+	}
+
+	resp, err := s.tcpQuery(context.Background(), []byte("query"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(resp) != "answer" {
+		t.Fatalf("got %q, want %q", resp, "answer")
+	}
+	if !broken.closed {
+		t.Fatal("expected the broken pooled connection to be closed after the failed write")
+	}
+	// The successful connection is returned to the pool for reuse.
+	if len(s.pool) != 1 || s.pool[0].Conn != working {
+		t.Fatalf("expected the working conn to be returned to the pool, got %+v", s.pool)
+	}
+}
+
+func TestTCPQueryAppliesCallerDeadline(t *testing.T) {
+	s := newTestTCPNameServer()
+	conn := &fakeTCPConn{readBuf: framedResponse([]byte("answer"))}
+	s.pool = []*pooledConn{{Conn: conn, lastUsed: time.Now()}}
+
+	deadline := time.Now().Add(5 * time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	if _, err := s.tcpQuery(ctx, []byte("query")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !conn.deadline.Equal(deadline) {
+		t.Fatalf("got deadline %v, want %v", conn.deadline, deadline)
+	}
+}